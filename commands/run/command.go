@@ -1,15 +1,19 @@
 package run
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/MatthiasHarzer/hka-2fa-proxy/otp"
 	"github.com/MatthiasHarzer/hka-2fa-proxy/proxy"
+	"github.com/MatthiasHarzer/hka-2fa-proxy/proxy/metrics"
+	"github.com/MatthiasHarzer/hka-2fa-proxy/proxy/sessionstore"
 	"github.com/spf13/cobra"
 )
 
@@ -20,6 +24,30 @@ var targetURL string
 var retryOnAuthFailure bool
 var maxRetries int
 var retryDelay = 30
+var skipAuth bool
+var authKey string
+var sessionStoreKind string
+var sessionFile string
+var sessionKey string
+var redisAddr string
+var redisKey string
+var multiTenantAuth string
+var credentialsFile string
+var oidcIssuerURL string
+var oidcClientID string
+var oidcClientSecret string
+var oidcRedirectURL string
+var oidcUsernameClaim string
+var oidcSessionKey string
+var hmacKey string
+var hmacHeaders []string
+var metricsKey string
+var rateLimitPerSecond float64
+var rateLimitBurst int
+var blockAfter int
+var blockWindow = 5 * time.Minute
+var blockDuration = 15 * time.Minute
+var allowedCIDRs []string
 
 func init() {
 	Command.Flags().StringVarP(&username, "username", "u", "", "The username to use for authentication")
@@ -29,6 +57,142 @@ func init() {
 	Command.Flags().BoolVarP(&retryOnAuthFailure, "retry-on-auth-failure", "r", false, "Whether to retry the request if authentication fails")
 	Command.Flags().IntVarP(&maxRetries, "max-retries", "m", 3, "The maximum number of retries if authentication fails")
 	Command.Flags().IntVarP(&retryDelay, "retry-delay", "d", 30, "The delay in seconds between retries if authentication fails")
+	Command.Flags().BoolVar(&skipAuth, "skip-auth", false, "Whether to skip the initial authentication (useful when restoring a session)")
+	Command.Flags().StringVarP(&authKey, "auth-key", "k", "", "A secret URL path segment required to reach the proxy, e.g. /_/<auth-key>/")
+	Command.Flags().StringVar(&sessionStoreKind, "session-store", "memory", "Where to persist the authenticated session: memory, file, or redis")
+	Command.Flags().StringVar(&sessionFile, "session-file", "session.enc", "Path to the encrypted session file (when --session-store=file)")
+	Command.Flags().StringVar(&sessionKey, "session-key", "", "Encryption key for the session file (when --session-store=file)")
+	Command.Flags().StringVar(&redisAddr, "redis-addr", "localhost:6379", "Redis address for the shared session (when --session-store=redis)")
+	Command.Flags().StringVar(&redisKey, "redis-key", "hka-2fa-proxy:session", "Redis key under which the session is stored (when --session-store=redis)")
+	Command.Flags().StringVar(&multiTenantAuth, "multi-tenant-auth", "none", "Per-user front-door authentication: none, htpasswd, or oidc")
+	Command.Flags().StringVar(&credentialsFile, "credentials-file", "", "Path to a \"username:bcryptHash:otpSecret\" credentials file (required for --multi-tenant-auth=htpasswd or oidc)")
+	Command.Flags().StringVar(&oidcIssuerURL, "oidc-issuer-url", "", "OIDC issuer URL (when --multi-tenant-auth=oidc)")
+	Command.Flags().StringVar(&oidcClientID, "oidc-client-id", "", "OIDC client ID (when --multi-tenant-auth=oidc)")
+	Command.Flags().StringVar(&oidcClientSecret, "oidc-client-secret", "", "OIDC client secret (when --multi-tenant-auth=oidc)")
+	Command.Flags().StringVar(&oidcRedirectURL, "oidc-redirect-url", "", "OIDC redirect URL, must resolve to proxy.OIDCCallbackPath (when --multi-tenant-auth=oidc)")
+	Command.Flags().StringVar(&oidcUsernameClaim, "oidc-username-claim", "email", "ID token claim used as the tenant ID and credentials-file lookup key (when --multi-tenant-auth=oidc)")
+	Command.Flags().StringVar(&oidcSessionKey, "oidc-session-key", "", "Key used to sign the OIDC session cookie (when --multi-tenant-auth=oidc)")
+	Command.Flags().StringVar(&hmacKey, "hmac-key", "", "If set, sign every upstream request with a Proxy-Signature header using this key, so a service behind this proxy can verify requests passed through it")
+	Command.Flags().StringSliceVar(&hmacHeaders, "hmac-headers", nil, "Headers to include in the Proxy-Signature (default: Content-Length, Content-Md5, Content-Type, Date, Authorization, X-Forwarded-User)")
+	Command.Flags().StringVar(&metricsKey, "metrics-key", "", "Secret required to reach /_metrics, mounted at /_metrics/<metrics-key>; if unset, /_metrics is not mounted at all")
+	Command.Flags().Float64Var(&rateLimitPerSecond, "rate-limit", 0, "Maximum sustained requests per second per remote IP on the authKey gate (0 disables rate limiting)")
+	Command.Flags().IntVar(&rateLimitBurst, "rate-limit-burst", 10, "Burst size for --rate-limit")
+	Command.Flags().IntVar(&blockAfter, "block-after", 0, "Block an IP after this many invalid auth-key attempts within --block-window (0 disables the block list)")
+	Command.Flags().DurationVar(&blockWindow, "block-window", blockWindow, "Sliding window in which --block-after invalid attempts trigger a block")
+	Command.Flags().DurationVar(&blockDuration, "block-duration", blockDuration, "How long a blocked IP is rejected for")
+	Command.Flags().StringSliceVar(&allowedCIDRs, "allow-cidr", nil, "If set, reject every request whose remote IP isn't inside one of these CIDRs (may be given multiple times)")
+}
+
+// rateLimiterConfig builds a proxy.RateLimiterConfig from the --rate-limit,
+// --block-after, and --allow-cidr flags.
+func rateLimiterConfig() (proxy.RateLimiterConfig, error) {
+	cidrs := make([]*net.IPNet, 0, len(allowedCIDRs))
+	for _, raw := range allowedCIDRs {
+		_, cidr, err := net.ParseCIDR(raw)
+		if err != nil {
+			return proxy.RateLimiterConfig{}, fmt.Errorf("invalid --allow-cidr %q: %w", raw, err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+
+	return proxy.RateLimiterConfig{
+		RatePerSecond: rateLimitPerSecond,
+		Burst:         rateLimitBurst,
+		BlockAfter:    blockAfter,
+		BlockWindow:   blockWindow,
+		BlockDuration: blockDuration,
+		AllowedCIDRs:  cidrs,
+	}, nil
+}
+
+// newSessionStore builds the proxy.SessionStore selected by --session-store.
+// tenantID is appended to the file path/Redis key in multi-tenant mode, so
+// each tenant's session is kept separate; pass "" in single-user mode.
+func newSessionStore(tenantID string) (proxy.SessionStore, error) {
+	switch sessionStoreKind {
+	case "memory", "":
+		return sessionstore.NewMemory(), nil
+	case "file":
+		path := sessionFile
+		if tenantID != "" {
+			path = fmt.Sprintf("%s.%s", sessionFile, tenantID)
+		}
+		return sessionstore.NewFile(path, sessionKey)
+	case "redis":
+		key := redisKey
+		if tenantID != "" {
+			key = fmt.Sprintf("%s:%s", redisKey, tenantID)
+		}
+		return sessionstore.NewRedis(redisAddr, key), nil
+	default:
+		return nil, fmt.Errorf("unknown session store %q", sessionStoreKind)
+	}
+}
+
+// newMultiTenantServer builds the proxy handler for --multi-tenant-auth
+// htpasswd/oidc, mounting the OIDC login/callback endpoints alongside it
+// where applicable.
+func newMultiTenantServer(limiter proxy.RateLimiterConfig) (http.Handler, error) {
+	if credentialsFile == "" {
+		return nil, errors.New("--credentials-file is required for multi-tenant auth")
+	}
+	credentials, err := proxy.NewHtpasswdAuthenticator(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load credentials file: %w", err)
+	}
+
+	var authenticator proxy.TenantAuthenticator
+	var oidcAuth *proxy.OIDCAuthenticator
+	switch multiTenantAuth {
+	case "htpasswd":
+		authenticator = credentials
+	case "oidc":
+		oidcAuth, err = proxy.NewOIDCAuthenticator(context.Background(), oidcIssuerURL, oidcClientID, oidcClientSecret, oidcRedirectURL, oidcUsernameClaim, oidcSessionKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not create OIDC authenticator: %w", err)
+		}
+		authenticator = oidcAuth
+	default:
+		return nil, fmt.Errorf("unknown multi-tenant auth %q", multiTenantAuth)
+	}
+
+	proxyHandler, err := proxy.NewMultiTenantServer(targetURL, authKey, authenticator, credentials, func(tenantID string) proxy.SessionStore {
+		store, err := newSessionStore(tenantID)
+		if err != nil {
+			log.Printf("could not create session store for %q, session will not persist: %v", tenantID, err)
+			return nil
+		}
+		return store
+	}, hmacKey, hmacHeaders, limiter)
+	if err != nil {
+		return nil, err
+	}
+
+	if oidcAuth == nil {
+		return proxyHandler, nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(proxy.OIDCLoginPath, oidcAuth.ServeLogin)
+	mux.HandleFunc(proxy.OIDCCallbackPath, oidcAuth.ServeCallback)
+	mux.Handle("/", proxyHandler)
+	return mux, nil
+}
+
+// withMetrics mounts the Prometheus metrics endpoint alongside handler,
+// under "/_metrics/<metricsKey>" so it's not reachable without knowing the
+// secret - the same routing-prefix approach --auth-key already uses for the
+// proxy itself. If --metrics-key is unset, /_metrics is not mounted at all
+// rather than left reachable with no gate.
+func withMetrics(handler http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	if metricsKey != "" {
+		mux.Handle("/_metrics/"+metricsKey, metrics.Handler())
+	} else {
+		log.Println("--metrics-key not set, /_metrics is disabled")
+	}
+	mux.Handle("/", handler)
+	return mux
 }
 
 var Command = &cobra.Command{
@@ -36,6 +200,25 @@ var Command = &cobra.Command{
 	Short: "Runs the proxy server",
 	Long:  "Runs the proxy server",
 	RunE: func(c *cobra.Command, args []string) error {
+		if strings.HasSuffix(targetURL, "/") {
+			targetURL = targetURL[:len(targetURL)-1]
+		}
+
+		limiter, err := rateLimiterConfig()
+		if err != nil {
+			return err
+		}
+
+		if multiTenantAuth != "none" {
+			server, err := newMultiTenantServer(limiter)
+			if err != nil {
+				return fmt.Errorf("could not create multi-tenant proxy server: %w", err)
+			}
+
+			log.Printf("starting multi-tenant (%s) server on port %d\n", multiTenantAuth, port)
+			return http.ListenAndServe(fmt.Sprintf(":%d", port), withMetrics(server))
+		}
+
 		if username == "" {
 			return errors.New("username is required")
 		}
@@ -48,8 +231,9 @@ var Command = &cobra.Command{
 			return err
 		}
 
-		if strings.HasSuffix(targetURL, "/") {
-			targetURL = targetURL[:len(targetURL)-1]
+		store, err := newSessionStore("")
+		if err != nil {
+			return fmt.Errorf("could not create session store: %w", err)
 		}
 
 		var server http.Handler
@@ -57,7 +241,7 @@ var Command = &cobra.Command{
 		retries := 0
 		for {
 			var err error
-			server, err = proxy.NewServer(targetURL, username, generator)
+			server, err = proxy.NewServer(targetURL, username, generator, skipAuth, authKey, store, hmacKey, hmacHeaders, limiter)
 			if err == nil {
 				break
 			}
@@ -74,7 +258,7 @@ var Command = &cobra.Command{
 
 		log.Printf("starting server on port %d\n", port)
 
-		err = http.ListenAndServe(fmt.Sprintf(":%d", port), server)
+		err = http.ListenAndServe(fmt.Sprintf(":%d", port), withMetrics(server))
 		return err
 	},
 }
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/MatthiasHarzer/hka-2fa-proxy/otp"
+)
+
+// Credentials pairs a username with the OTP generator used to authenticate
+// that user's upstream session.
+type Credentials struct {
+	Username     string
+	OTPGenerator otp.Generator
+}
+
+// CredentialSource resolves a tenant ID (typically a username or email) to
+// the credentials used to authenticate that tenant's upstream session.
+type CredentialSource interface {
+	Lookup(tenantID string) (Credentials, bool)
+}
+
+// TenantAuthenticator identifies the caller of an incoming request - the
+// proxy's front door in multi-tenant mode. It returns the tenant ID to
+// authenticate and proxy as. If the caller isn't recognized, it returns
+// ok=false after writing a challenge or redirect response of its own
+// (a 401 with WWW-Authenticate, a redirect to an identity provider, ...).
+type TenantAuthenticator interface {
+	Authenticate(w http.ResponseWriter, r *http.Request) (tenantID string, ok bool)
+}
+
+// fixedTenantAuthenticator always identifies the caller as the same tenant,
+// reproducing the proxy's original single-user behavior: anyone who can
+// reach the authKey-gated URL is that one configured user.
+type fixedTenantAuthenticator struct {
+	tenantID string
+}
+
+func (a fixedTenantAuthenticator) Authenticate(http.ResponseWriter, *http.Request) (string, bool) {
+	return a.tenantID, true
+}
+
+// singleCredentialSource resolves every lookup to the same, fixed credentials.
+type singleCredentialSource struct {
+	credentials Credentials
+}
+
+func (s singleCredentialSource) Lookup(string) (Credentials, bool) {
+	return s.credentials, true
+}
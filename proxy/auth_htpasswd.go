@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/MatthiasHarzer/hka-2fa-proxy/otp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdEntry is one line of a credentials file: a username, its bcrypt
+// password hash, and the TOTP secret used to authenticate that user's
+// upstream OWA session.
+type htpasswdEntry struct {
+	username     string
+	passwordHash string
+	otpGenerator otp.Generator
+}
+
+// HtpasswdAuthenticator authenticates callers via HTTP Basic auth against an
+// htpasswd-style credentials file extended with a third, per-user TOTP
+// secret column: "username:bcryptHash:otpSecret", one entry per line.
+// Blank lines and lines starting with '#' are ignored.
+type HtpasswdAuthenticator struct {
+	mu      sync.RWMutex
+	entries map[string]htpasswdEntry
+}
+
+// NewHtpasswdAuthenticator loads credentials from path.
+func NewHtpasswdAuthenticator(path string) (*HtpasswdAuthenticator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open credentials file: %w", err)
+	}
+	defer file.Close()
+
+	entries := map[string]htpasswdEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid credentials line %q, expected username:hash:otpSecret", line)
+		}
+		username, hash, otpSecret := parts[0], parts[1], parts[2]
+
+		generator, err := otp.NewGenerator(otpSecret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTP secret for user %q: %w", username, err)
+		}
+
+		entries[username] = htpasswdEntry{username: username, passwordHash: hash, otpGenerator: generator}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read credentials file: %w", err)
+	}
+
+	return &HtpasswdAuthenticator{entries: entries}, nil
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="hka-2fa-proxy"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return "", false
+	}
+
+	a.mu.RLock()
+	entry, known := a.entries[username]
+	a.mu.RUnlock()
+	if !known {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return "", false
+	}
+
+	// htpasswd commonly uses the "$2y$" bcrypt variant marker; Go's bcrypt
+	// only recognizes "$2a$"/"$2b$", but the hash format is otherwise identical.
+	hash := strings.Replace(entry.passwordHash, "$2y$", "$2a$", 1)
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return "", false
+	}
+
+	return username, true
+}
+
+func (a *HtpasswdAuthenticator) Lookup(tenantID string) (Credentials, bool) {
+	a.mu.RLock()
+	entry, ok := a.entries[tenantID]
+	a.mu.RUnlock()
+	if !ok {
+		return Credentials{}, false
+	}
+	return Credentials{Username: entry.username, OTPGenerator: entry.otpGenerator}, true
+}
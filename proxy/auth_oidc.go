@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// OIDCLoginPath and OIDCCallbackPath are where OIDCAuthenticator.ServeLogin
+	// and ServeCallback must be mounted, ahead of the proxy handler itself.
+	OIDCLoginPath    = "/_/oidc/login"
+	OIDCCallbackPath = "/_/oidc/callback"
+
+	oidcSessionCookieName = "hka_2fa_session"
+	oidcStateCookieName   = "hka_2fa_oidc_state"
+	oidcStateCookieMaxAge = 10 * time.Minute
+	oidcDefaultSessionTTL = 24 * time.Hour
+)
+
+// OIDCAuthenticator delegates front-door authentication to an OIDC provider,
+// oauth2-proxy style: an unauthenticated caller is redirected to the
+// provider, and on a successful callback is issued an HMAC-signed session
+// cookie carrying their identity. Subsequent requests are authenticated
+// directly against that cookie, without involving the provider again.
+type OIDCAuthenticator struct {
+	verifier      *oidc.IDTokenVerifier
+	oauth2Config  oauth2.Config
+	usernameClaim string
+	signingKey    []byte
+	sessionTTL    time.Duration
+}
+
+// NewOIDCAuthenticator discovers the provider at issuerURL and configures the
+// OAuth2 authorization code flow for redirectURL. signingKey authenticates
+// the session cookie issued after a successful login; usernameClaim selects
+// which ID token claim identifies the tenant (commonly "email" or
+// "preferred_username") and is used as both the tenant ID and the
+// CredentialSource lookup key.
+func NewOIDCAuthenticator(ctx context.Context, issuerURL, clientID, clientSecret, redirectURL, usernameClaim, signingKey string) (*OIDCAuthenticator, error) {
+	provider, err := oidc.NewProvider(ctx, issuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover OIDC provider: %w", err)
+	}
+
+	return &OIDCAuthenticator{
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+		oauth2Config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		usernameClaim: usernameClaim,
+		signingKey:    []byte(signingKey),
+		sessionTTL:    oidcDefaultSessionTTL,
+	}, nil
+}
+
+func (a *OIDCAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(oidcSessionCookieName)
+	if err != nil {
+		a.redirectToLogin(w, r)
+		return "", false
+	}
+
+	username, err := a.verifySessionCookie(cookie.Value)
+	if err != nil {
+		a.redirectToLogin(w, r)
+		return "", false
+	}
+
+	return username, true
+}
+
+// ServeLogin starts the OAuth2 authorization code flow. Mount it at OIDCLoginPath.
+func (a *OIDCAuthenticator) ServeLogin(w http.ResponseWriter, r *http.Request) {
+	state := randomState()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		MaxAge:   int(oidcStateCookieMaxAge / time.Second),
+	})
+	http.Redirect(w, r, a.oauth2Config.AuthCodeURL(state), http.StatusFound)
+}
+
+// ServeCallback completes the OAuth2 authorization code flow and issues the
+// signed session cookie. Mount it at OIDCCallbackPath, matching redirectURL.
+func (a *OIDCAuthenticator) ServeCallback(w http.ResponseWriter, r *http.Request) {
+	stateCookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || r.URL.Query().Get("state") != stateCookie.Value {
+		http.Error(w, "invalid OAuth2 state", http.StatusBadRequest)
+		return
+	}
+
+	token, err := a.oauth2Config.Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		http.Error(w, "could not exchange authorization code: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "OAuth2 token response did not include an id_token", http.StatusBadGateway)
+		return
+	}
+
+	idToken, err := a.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		http.Error(w, "could not verify ID token: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, "could not parse ID token claims", http.StatusUnauthorized)
+		return
+	}
+	username, _ := claims[a.usernameClaim].(string)
+	if username == "" {
+		http.Error(w, fmt.Sprintf("ID token is missing the %q claim", a.usernameClaim), http.StatusUnauthorized)
+		return
+	}
+
+	http.SetCookie(w, a.signSessionCookie(username))
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (a *OIDCAuthenticator) redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, OIDCLoginPath, http.StatusFound)
+}
+
+func (a *OIDCAuthenticator) signSessionCookie(username string) *http.Cookie {
+	expires := time.Now().Add(a.sessionTTL)
+	payload := username + "|" + strconv.FormatInt(expires.Unix(), 10)
+	value := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + a.sign(payload)
+
+	return &http.Cookie{
+		Name:     oidcSessionCookieName,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Expires:  expires,
+	}
+}
+
+func (a *OIDCAuthenticator) verifySessionCookie(value string) (string, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed session cookie")
+	}
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("malformed session cookie: %w", err)
+	}
+	payload := string(payloadBytes)
+
+	if !hmac.Equal([]byte(a.sign(payload)), []byte(parts[1])) {
+		return "", fmt.Errorf("invalid session signature")
+	}
+
+	fields := strings.SplitN(payload, "|", 2)
+	if len(fields) != 2 {
+		return "", fmt.Errorf("malformed session payload")
+	}
+	expiresUnix, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed session expiry: %w", err)
+	}
+	if time.Now().Unix() > expiresUnix {
+		return "", fmt.Errorf("session expired")
+	}
+
+	return fields[0], nil
+}
+
+func (a *OIDCAuthenticator) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.signingKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomState() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type contextKey int
+
+const (
+	tenantContextKey contextKey = iota
+	requestMetricsContextKey
+)
+
+// withTenant attaches the resolved tenant to a request context, so the
+// reverse proxy's Director and ModifyResponse hooks - which only see the
+// *http.Request - can look up which tenant's jar and credentials to use.
+func withTenant(ctx context.Context, t *tenant) context.Context {
+	return context.WithValue(ctx, tenantContextKey, t)
+}
+
+func tenantFromRequest(r *http.Request) *tenant {
+	t, _ := r.Context().Value(tenantContextKey).(*tenant)
+	return t
+}
+
+// requestMetrics collects facts gathered deep in the proxying pipeline -
+// past where ServeHTTP's own stack frame can see them - so ServeHTTP's
+// final structured log line can still report them.
+type requestMetrics struct {
+	reauthOutcome    string
+	upstreamDuration time.Duration
+}
+
+// withRequestMetrics attaches a requestMetrics to ctx and returns it so the
+// caller can fill it in as the request is processed.
+func withRequestMetrics(ctx context.Context) (context.Context, *requestMetrics) {
+	m := &requestMetrics{}
+	return context.WithValue(ctx, requestMetricsContextKey, m), m
+}
+
+func requestMetricsFromRequest(r *http.Request) *requestMetrics {
+	m, _ := r.Context().Value(requestMetricsContextKey).(*requestMetrics)
+	return m
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultHMACHeaders are the headers signed into Proxy-Signature when
+// --hmac-headers is not given, matching oauth2-proxy's hmacauth defaults
+// minus Cookie plus the identity header this proxy injects. Cookie is left
+// out deliberately: director signs the request before the per-tenant cookie
+// jar attaches the real upstream cookies (that happens later, inside
+// tenant.doRequest), so by the time sign runs Cookie has already been
+// deleted and would always sign as empty. Pass --hmac-headers explicitly if
+// a downstream verifier needs Cookie covered.
+var defaultHMACHeaders = []string{
+	"Content-Length",
+	"Content-Md5",
+	"Content-Type",
+	"Date",
+	"Authorization",
+	"X-Forwarded-User",
+}
+
+// hmacSigner signs a fixed set of request headers into a Proxy-Signature
+// header on every upstream request, oauth2-proxy GAP-Signature style, so a
+// service placed behind this proxy can cryptographically verify that a
+// request actually passed through the 2FA gate rather than reaching it
+// directly.
+type hmacSigner struct {
+	key     []byte
+	headers []string
+}
+
+// newHMACSigner returns nil if key is empty, which disables signing entirely.
+func newHMACSigner(key string, headers []string) *hmacSigner {
+	if key == "" {
+		return nil
+	}
+	if len(headers) == 0 {
+		headers = defaultHMACHeaders
+	}
+	return &hmacSigner{key: []byte(key), headers: headers}
+}
+
+// sign computes the Proxy-Signature header for r and sets it, overwriting
+// any value already present. It must run after every other mutation to r's
+// headers, since the signature covers exactly what is sent upstream.
+func (s *hmacSigner) sign(r *http.Request) {
+	r.Header.Set("Proxy-Signature", s.signatureFor(r))
+}
+
+func (s *hmacSigner) signatureFor(r *http.Request) string {
+	mac := hmac.New(sha256.New, s.key)
+	fmt.Fprintf(mac, "%s\n%s\n", r.Method, r.URL.RequestURI())
+	for _, header := range s.headers {
+		// Content-Length lives in r.ContentLength, not r.Header: director
+		// buffers the body and sets that field directly without ever
+		// populating a "Content-Length" entry in r.Header.
+		value := r.Header.Get(header)
+		if strings.EqualFold(header, "Content-Length") {
+			value = strconv.FormatInt(r.ContentLength, 10)
+		}
+		fmt.Fprintf(mac, "%s:%s\n", header, value)
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,70 @@
+// Package metrics exposes the Prometheus collectors this proxy reports, and
+// the /_metrics endpoint that serves them.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// RequestsTotal counts every proxied request by the status code returned
+	// to the client.
+	RequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hka_2fa_proxy_requests_total",
+		Help: "Total number of proxied requests, by response status code.",
+	}, []string{"status"})
+
+	// UpstreamDuration tracks how long the round trip to the upstream target
+	// took, by the status code it returned.
+	UpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hka_2fa_proxy_upstream_duration_seconds",
+		Help:    "Latency of requests to the upstream target, by response status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"status"})
+
+	// ReauthenticationsTotal counts upstream re-authentication attempts,
+	// triggered when a response turns out to be a stale-session login page.
+	ReauthenticationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hka_2fa_proxy_reauthentications_total",
+		Help: "Number of upstream re-authentications, by outcome.",
+	}, []string{"outcome"})
+
+	// OTPWaitSeconds measures time spent waiting for the next TOTP interval
+	// before a login submission, since a code can only be used once.
+	OTPWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "hka_2fa_proxy_otp_wait_seconds",
+		Help:    "Time spent waiting for a fresh TOTP code before submitting login.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// UnauthorizedAttemptsTotal counts requests rejected by the authKey gate.
+	// Deliberately unlabeled: the remote IP is unbounded cardinality, and a
+	// scanner hitting this counter from many source IPs would otherwise
+	// create one time series per IP. Log the IP instead if per-IP visibility
+	// is needed.
+	UnauthorizedAttemptsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hka_2fa_proxy_unauthorized_attempts_total",
+		Help: "Total number of requests rejected for a missing or incorrect auth-key.",
+	})
+
+	// GateDecisionsTotal counts every request the IP gate (CIDR allowlist,
+	// brute-force block list, per-IP rate limit) rejects ahead of the authKey
+	// check, by decision. Requests the gate lets through are not counted.
+	GateDecisionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hka_2fa_proxy_gate_decisions_total",
+		Help: "Decisions made by the IP gate ahead of the authKey check, by decision (cidr_denied, blocked, rate_limited).",
+	}, []string{"decision"})
+)
+
+func init() {
+	prometheus.MustRegister(RequestsTotal, UpstreamDuration, ReauthenticationsTotal, OTPWaitSeconds, UnauthorizedAttemptsTotal, GateDecisionsTotal)
+}
+
+// Handler serves the Prometheus exposition format. run.Command mounts it at
+// /_metrics/<metrics-key>.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -1,30 +1,32 @@
 package proxy
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"net/http/cookiejar"
+	"net/http/httputil"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/MatthiasHarzer/hka-2fa-proxy/otp"
+	"github.com/MatthiasHarzer/hka-2fa-proxy/proxy/metrics"
 )
 
 // validAuthKey matches only safe characters for use in a URL path segment.
 var validAuthKey = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
 
-// errUnauthorized is returned by proxyRequest when the request lacks a valid auth key.
-// The HTTP 401 response has already been written to the client at that point.
-var errUnauthorized = errors.New("unauthorized")
-
 const (
 	userAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/140.0.0.0 Safari/537.36"
 )
@@ -49,230 +51,225 @@ func isRedirectToLogin(response *http.Response) bool {
 }
 
 type server struct {
-	otpGenerator  otp.Generator
 	targetBaseURL string
-	username      string
-	jar           *cookiejar.Jar
-	jarMutex      *sync.RWMutex
 	authKey       string
+	reverseProxy  *httputil.ReverseProxy
+
+	// hmacSigner is nil unless --hmac-key was given, which disables
+	// Proxy-Signature signing entirely.
+	hmacSigner *hmacSigner
+
+	// ipGate is nil unless RateLimiterConfig turns on at least one of rate
+	// limiting, the brute-force block list, or the CIDR allowlist.
+	ipGate *ipGate
+
+	// Exactly one of tenant and tenants is set: tenant for the original
+	// single-user mode, tenants when running multi-tenant.
+	tenant  *tenant
+	tenants *tenantManager
 }
 
-func NewServer(targetBaseURL, username string, otpGenerator otp.Generator, skipAuth bool, authKey string) (http.Handler, error) {
+// NewServer creates the proxy handler for the original single-user mode: one
+// hard-coded username/OTP secret, authenticated eagerly at startup (unless
+// skipAuth is set). If sessionStore is non-nil and already holds a session,
+// it is restored instead of performing a fresh login - letting the process
+// restart, or another replica start up, without consuming a TOTP code. Pass
+// a sessionstore.Memory to keep the original process-local-only behavior.
+//
+// For per-user authentication, see NewMultiTenantServer.
+//
+// If hmacKey is non-empty, every upstream request is signed with a
+// Proxy-Signature header covering hmacHeaders (or a sensible default set if
+// hmacHeaders is empty), oauth2-proxy GAP-Signature style, so a service
+// placed behind this proxy can verify the request actually passed through
+// the 2FA gate. rateLimiter configures per-IP rate limiting, the brute-force
+// block list, and the CIDR allowlist on the authKey gate; its zero value
+// disables all three.
+func NewServer(targetBaseURL, username string, otpGenerator otp.Generator, skipAuth bool, authKey string, sessionStore SessionStore, hmacKey string, hmacHeaders []string, rateLimiter RateLimiterConfig) (http.Handler, error) {
 	if authKey != "" && !validAuthKey.MatchString(authKey) {
 		return nil, fmt.Errorf("authKey must contain only alphanumeric characters, hyphens, and underscores")
 	}
+
+	t, err := newTenant("default", targetBaseURL, username, otpGenerator, sessionStore)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize session: %w", err)
+	}
+
 	sv := &server{
 		targetBaseURL: targetBaseURL,
-		otpGenerator:  otpGenerator,
-		username:      username,
-		jarMutex:      &sync.RWMutex{},
 		authKey:       authKey,
+		hmacSigner:    newHMACSigner(hmacKey, hmacHeaders),
+		tenant:        t,
 	}
-	if !skipAuth {
-		err := sv.authenticateClient()
+	if rateLimiter.enabled() {
+		sv.ipGate = newIPGate(rateLimiter)
+	}
+	sv.reverseProxy = sv.newReverseProxy()
+
+	if t.sessionStore != nil {
+		restored, err := t.restoreSession()
 		if err != nil {
-			return nil, fmt.Errorf("could not authenticate client: %w", err)
+			return nil, fmt.Errorf("could not restore session: %w", err)
 		}
-	} else {
-		err := sv.clearCookies()
-		if err != nil {
-			return nil, fmt.Errorf("could not clear cookies: %w", err)
+		if restored {
+			log.Println("restored session from session store")
+			return sv, nil
 		}
 	}
-	return sv, nil
-}
 
-// getLoginParameters performs the initial request to get session cookies and login form parameters.
-func (s *server) getLoginParameters() (url.Values, string, error) {
-	// Create a request so we can set headers
-	initialURL := s.targetBaseURL + "/"
-	req, err := http.NewRequest("GET", initialURL, nil)
-	if err != nil {
-		return nil, "", fmt.Errorf("could not create initial request: %w", err)
+	if !skipAuth {
+		if err := t.authenticateClient(); err != nil {
+			return nil, fmt.Errorf("could not authenticate client: %w", err)
+		}
 	}
-	req.Header.Set("User-Agent", userAgent)
+	return sv, nil
+}
 
-	// The client's CheckRedirect is configured to stop redirects
-	resp, err := s.doRequest(req)
-	if err != nil {
-		return nil, "", fmt.Errorf("initial GET request failed: %w", err)
+// NewMultiTenantServer creates a proxy handler that authenticates each
+// caller individually: auth identifies the caller of every request (Basic
+// auth against a credentials file, a signed OIDC session cookie, ...),
+// credentials resolves that caller's username/OTP secret, and each tenant's
+// upstream session - and cookie jar - is authenticated lazily on first use
+// and kept isolated from every other tenant. sessionStore, if non-nil, is
+// called once per newly-seen tenant ID to build that tenant's SessionStore.
+// hmacKey and hmacHeaders behave as documented on NewServer, as does
+// rateLimiter.
+func NewMultiTenantServer(targetBaseURL, authKey string, auth TenantAuthenticator, credentials CredentialSource, sessionStore func(tenantID string) SessionStore, hmacKey string, hmacHeaders []string, rateLimiter RateLimiterConfig) (http.Handler, error) {
+	if authKey != "" && !validAuthKey.MatchString(authKey) {
+		return nil, fmt.Errorf("authKey must contain only alphanumeric characters, hyphens, and underscores")
 	}
-	defer resp.Body.Close()
 
-	// We expect a 302 Found status code
-	if resp.StatusCode != http.StatusFound {
-		return nil, "", fmt.Errorf("expected a 302 redirect, but got status %s", resp.Status)
+	sv := &server{
+		targetBaseURL: targetBaseURL,
+		authKey:       authKey,
+		hmacSigner:    newHMACSigner(hmacKey, hmacHeaders),
+		tenants:       newTenantManager(targetBaseURL, auth, credentials, sessionStore),
 	}
-
-	locationHeader := resp.Header.Get("Location")
-	if locationHeader == "" {
-		return nil, "", fmt.Errorf("'Location' header not found in the response")
+	if rateLimiter.enabled() {
+		sv.ipGate = newIPGate(rateLimiter)
 	}
+	sv.reverseProxy = sv.newReverseProxy()
+	return sv, nil
+}
 
-	// Parse parameters from the unusual URL format (split by '?')
-	parts := strings.Split(locationHeader, "?")
-	if len(parts) < 2 {
-		return nil, "", fmt.Errorf("could not parse query string from location: %s", locationHeader)
+func (s *server) newReverseProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director:       s.director,
+		ModifyResponse: s.modifyResponse,
+		ErrorHandler:   s.handleProxyError,
+		Transport:      decodingTransport{&upstreamTransport{}},
 	}
-	parsedParams, err := url.ParseQuery(parts[len(parts)-1])
-	if err != nil {
-		return nil, "", fmt.Errorf("could not parse query parameters: %w", err)
-	}
-
-	refererURL := s.targetBaseURL + locationHeader
-	return parsedParams, refererURL, nil
 }
 
-// submitLogin prompts for credentials and submits the login form.
-func (s *server) submitLogin(params url.Values, refererURL, username, password string) (*http.Response, error) {
-	// Prepare form data for the POST request
-	formData := url.Values{}
-	formData.Set("curl", params.Get("curl"))
-	formData.Set("curlid", params.Get("curlid"))
-	formData.Set("curlmode", params.Get("curlmode"))
-	formData.Set("username", strings.TrimSpace(username))
-	formData.Set("password", password)
-
-	postURL := fmt.Sprintf("%s/lm_auth_proxy?LMLogon", s.targetBaseURL)
+// upstreamTransport adapts the calling tenant's cookie-jar-aware HTTP client
+// into an http.RoundTripper so it can be plugged in as the reverse proxy's
+// Transport. The tenant travels on the request context (see context.go),
+// attached by server.ServeHTTP before the reverse proxy ever sees the request.
+type upstreamTransport struct{}
 
-	req, err := http.NewRequest("POST", postURL, strings.NewReader(formData.Encode()))
-	if err != nil {
-		return nil, fmt.Errorf("could not create POST request: %w", err)
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tn := tenantFromRequest(req)
+	if tn == nil {
+		return nil, fmt.Errorf("no tenant resolved for request")
 	}
 
-	// Set necessary headers
-	req.Header.Set("User-Agent", userAgent)
-	req.Header.Set("Referer", refererURL)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	// Execute the request
-	resp, err := s.doRequest(req)
-	if err != nil {
-		return nil, fmt.Errorf("login POST request failed: %w", err)
+	start := time.Now()
+	resp, err := tn.doRequest(req)
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	elapsed := time.Since(start)
+	metrics.UpstreamDuration.WithLabelValues(status).Observe(elapsed.Seconds())
+	if m := requestMetricsFromRequest(req); m != nil {
+		m.upstreamDuration += elapsed
 	}
 
-	return resp, nil
+	return resp, err
 }
 
-func (s *server) clearCookies() error {
-	s.jarMutex.Lock()
-	defer s.jarMutex.Unlock()
-
-	jar, err := cookiejar.New(nil)
-	if err != nil {
-		return fmt.Errorf("could not create cookie jar: %w", err)
-	}
-	s.jar = jar
-	return nil
+// decodingTransport wraps a RoundTripper and transparently ungzips response
+// bodies, so the rewriter and the streaming passthrough for large bodies
+// never have to deal with compressed bytes regardless of what upstream sends.
+type decodingTransport struct {
+	http.RoundTripper
 }
 
-func (s *server) authenticateClient() error {
-	log.Println("authenticating client")
-
-	err := s.clearCookies()
-	if err != nil {
-		return fmt.Errorf("could not clear cookies: %w", err)
+func (t decodingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil || resp == nil {
+		return resp, err
 	}
 
-	loginParams, refererURL, err := s.getLoginParameters()
-	if err != nil {
-		return fmt.Errorf("could not get login parameters: %w", err)
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp, nil
 	}
 
-	// This is required, as one OTP can only be used once. To prevent timing issues, we wait for the next interval.
-	s.otpGenerator.WaitForNextInterval()
-	password := s.otpGenerator.Generate(time.Now())
-
-	loginResp, err := s.submitLogin(loginParams, refererURL, s.username, password)
+	gzipReader, err := gzip.NewReader(resp.Body)
 	if err != nil {
-		return fmt.Errorf("could not submit login: %w", err)
+		return nil, fmt.Errorf("could not decode gzip response: %w", err)
 	}
-	defer loginResp.Body.Close()
+	resp.Body = &decodedBody{Reader: gzipReader, underlying: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
 
-	if !isLoginSuccessful(loginResp) {
-		return fmt.Errorf("login failed")
-	}
-
-	log.Println("client authenticated successfully")
-
-	return nil
+	return resp, nil
 }
 
-func (s *server) getHttpClient(url *url.URL) (*http.Client, error) {
-	s.jarMutex.RLock()
-	defer s.jarMutex.RUnlock()
-
-	jar, err := cookiejar.New(nil)
-	if err != nil {
-		return nil, fmt.Errorf("could not create cookie jar: %w", err)
-	}
-
-	cookies := s.jar.Cookies(url)
-	jar.SetCookies(url, cookies)
-
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-		Jar:     jar,
-	}
-
-	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		// This stops the client from following any redirects
-		return http.ErrUseLastResponse
-	}
-
-	return client, nil
+// decodedBody closes both the decoder and the underlying network body it reads from.
+type decodedBody struct {
+	*gzip.Reader
+	underlying io.ReadCloser
 }
 
-func (s *server) saveCookiesFromResponse(url *url.URL, resp *http.Response) {
-	cookies := resp.Cookies()
-	if len(cookies) == 0 {
-		return
+func (b *decodedBody) Close() error {
+	err := b.Reader.Close()
+	if closeErr := b.underlying.Close(); closeErr != nil && err == nil {
+		err = closeErr
 	}
+	return err
+}
 
-	s.jarMutex.Lock()
-	defer s.jarMutex.Unlock()
-
-	for _, cookie := range cookies {
-		s.jar.SetCookies(url, []*http.Cookie{cookie})
+// prefixPath applies the "/_/<authKey>" routing prefix this proxy is reachable under.
+func (s *server) prefixPath(path string) string {
+	if s.authKey == "" {
+		return path
 	}
+	return "/_/" + s.authKey + path
 }
 
-func (s *server) doRequest(req *http.Request) (*http.Response, error) {
-	client, err := s.getHttpClient(req.URL)
-	if err != nil {
-		return nil, fmt.Errorf("could not get HTTP client: %w", err)
+// rewriteURL rewrites a URL discovered in proxied content (an href, src, form
+// action, CSS url(), or similar) so that it keeps routing back through this
+// proxy instead of going straight to the upstream.
+func (s *server) rewriteURL(raw string) string {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return raw
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	lower := strings.ToLower(trimmed)
+	if strings.HasPrefix(lower, "data:") || strings.HasPrefix(lower, "mailto:") ||
+		strings.HasPrefix(lower, "javascript:") || strings.HasPrefix(trimmed, "#") {
+		return raw
 	}
-	s.saveCookiesFromResponse(req.URL, resp)
 
-	return resp, nil
-}
-
-func (s *server) replaceHTMLContent(body string) string {
-	newBody := body
-
-	if s.authKey != "" {
-		// qisserver forward
-		newBody = strings.ReplaceAll(newBody, `URL=/`, fmt.Sprintf(`URL=/_/%s/`, s.authKey))
+	if strings.HasPrefix(trimmed, s.targetBaseURL) {
+		rest := strings.TrimPrefix(trimmed, s.targetBaseURL)
+		if rest == "" {
+			rest = "/"
+		}
+		return s.prefixPath(rest)
+	}
 
-		// Quick and dirty way to rewrite URLs in form action attributes and links
-		newBody = strings.ReplaceAll(newBody, `action="/`, fmt.Sprintf(`action="/_/%s/`, s.authKey))
-		newBody = strings.ReplaceAll(newBody, `href="/`, fmt.Sprintf(`href="/_/%s/`, s.authKey))
-		newBody = strings.ReplaceAll(newBody, `src="/`, fmt.Sprintf(`src="/_/%s/`, s.authKey))
-		newBody = strings.ReplaceAll(newBody, fmt.Sprintf(`action="%s/`, s.targetBaseURL), fmt.Sprintf(`action="/_/%s/`, s.authKey))
-		newBody = strings.ReplaceAll(newBody, fmt.Sprintf(`href="%s/`, s.targetBaseURL), fmt.Sprintf(`href="/_/%s/`, s.authKey))
-		newBody = strings.ReplaceAll(newBody, fmt.Sprintf(`src="%s/`, s.targetBaseURL), fmt.Sprintf(`src="/_/%s/`, s.authKey))
-	} else {
-		newBody = strings.ReplaceAll(newBody, fmt.Sprintf(`action="%s/`, s.targetBaseURL), `action="/`)
-		newBody = strings.ReplaceAll(newBody, fmt.Sprintf(`href="%s/`, s.targetBaseURL), `href="/`)
-		newBody = strings.ReplaceAll(newBody, fmt.Sprintf(`src="%s/`, s.targetBaseURL), `src="/`)
+	if strings.HasPrefix(trimmed, "/") && !strings.HasPrefix(trimmed, "//") {
+		return s.prefixPath(trimmed)
 	}
 
-	return newBody
+	// Relative paths, scheme-relative URLs ("//host/..."), and links to other
+	// hosts are left untouched - they either resolve correctly relative to the
+	// already-rewritten page, or intentionally point outside the proxy.
+	return raw
 }
 
 func (s *server) isAuthorizedRequest(r *http.Request) bool {
@@ -289,7 +286,24 @@ func (s *server) isAuthorizedRequest(r *http.Request) bool {
 	return false
 }
 
+// hasDotDotSegment reports whether any "/"-separated segment of p is "..",
+// which resolveTargetRequestURI rejects outright rather than trying to
+// resolve, so a request like "/_/<authKey>/../foo" can never make it to the
+// upstream target as "/../foo".
+func hasDotDotSegment(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *server) resolveTargetRequestURI(r *http.Request) (string, error) {
+	if hasDotDotSegment(r.URL.Path) {
+		return "", fmt.Errorf("invalid request path: %s", r.URL.Path)
+	}
+
 	if s.authKey == "" {
 		uri := r.URL.Path
 		if r.URL.RawQuery != "" {
@@ -313,149 +327,338 @@ func (s *server) resolveTargetRequestURI(r *http.Request) (string, error) {
 	return "", fmt.Errorf("invalid request URI: %s", r.RequestURI)
 }
 
-func (s *server) getLocation(location string) string {
-	// If the location is an absolute URL under the target base URL, strip the base.
-	if strings.HasPrefix(location, s.targetBaseURL) {
-		trimmed := strings.TrimPrefix(location, s.targetBaseURL)
-		if trimmed == "" {
-			trimmed = "/"
-		}
-		if s.authKey == "" {
-			return trimmed
-		}
-		return "/_/" + s.authKey + trimmed
+// director rewrites an incoming client request into one bound for the
+// upstream target, stripping the authKey routing prefix and the headers that
+// must never be forwarded verbatim.
+func (s *server) director(r *http.Request) {
+	requestURI, err := s.resolveTargetRequestURI(r)
+	if err != nil {
+		// ServeHTTP already rejects a request resolveTargetRequestURI can't
+		// resolve before the reverse proxy ever calls director, so this is
+		// unreachable in practice; fall back to the upstream root rather
+		// than forwarding whatever was rejected, just in case.
+		requestURI = "/"
 	}
 
-	// For relative paths (starting with '/'), rewrite them to pass through the proxy.
-	if strings.HasPrefix(location, "/") {
-		if s.authKey == "" {
-			return location
+	target, err := url.Parse(s.targetBaseURL + requestURI)
+	if err != nil {
+		target, _ = url.Parse(s.targetBaseURL)
+	}
+	r.URL = target
+	r.Host = target.Host
+
+	r.Header.Del("Cookie")
+	r.Header.Del("Referer")
+	r.Header.Del("Accept-Encoding")
+	r.Header.Set("User-Agent", userAgent)
+	r.Header.Set("Origin", s.targetBaseURL)
+
+	if r.Body != nil && r.Body != http.NoBody && r.GetBody == nil {
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err == nil {
+			r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+			r.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(bodyBytes)), nil
+			}
+			r.ContentLength = int64(len(bodyBytes))
 		}
-		return "/_/" + s.authKey + location
 	}
 
-	// For other absolute URLs or unusual values, return as-is to avoid creating malformed URLs.
-	return location
+	s.injectForwardedHeaders(r)
+
+	if s.hmacSigner != nil {
+		s.hmacSigner.sign(r)
+	}
 }
 
-func (s *server) proxyRequest(w http.ResponseWriter, r *http.Request) error {
-	if !s.isAuthorizedRequest(r) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return errUnauthorized
+// injectForwardedHeaders tells the upstream - or, via Proxy-Signature, a
+// further service chained behind it - who the client is and where they
+// connected from, the identity this proxy's 2FA gate already established.
+// The inbound X-Forwarded-User is always discarded first so a client cannot
+// spoof an identity the proxy never authenticated.
+func (s *server) injectForwardedHeaders(r *http.Request) {
+	ip := clientIP(r)
+
+	if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+		r.Header.Set("X-Forwarded-For", prior+", "+ip)
+	} else {
+		r.Header.Set("X-Forwarded-For", ip)
 	}
-	requestURI, err := s.resolveTargetRequestURI(r)
-	if err != nil {
-		return fmt.Errorf("could not resolve target request URI: %w", err)
+	r.Header.Set("X-Real-IP", ip)
+
+	r.Header.Del("X-Forwarded-User")
+	if t := tenantFromRequest(r); t != nil {
+		r.Header.Set("X-Forwarded-User", t.username)
 	}
+}
 
-	bodyBytes, err := io.ReadAll(r.Body)
+// clientIP extracts the remote IP from r, stripping the port RemoteAddr
+// always carries.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return fmt.Errorf("could not read request body: %w", err)
+		return r.RemoteAddr
 	}
-	bodyString := string(bodyBytes)
+	return host
+}
 
-	// Create a new request based on the original one
-	proxyReq, err := http.NewRequest(r.Method, s.targetBaseURL+requestURI, strings.NewReader(bodyString))
-	if err != nil {
-		return err
+// newRequestID returns a short random hex identifier that tags a request's
+// structured log line in ServeHTTP. Log lines written during re-auth do not
+// carry it.
+func newRequestID() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// statusRecorder captures the status code written to an http.ResponseWriter,
+// which the reverse proxy and its ErrorHandler otherwise give no way to
+// observe from the outside.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap exposes the wrapped ResponseWriter to http.NewResponseController,
+// so callers reaching for optional interfaces the embedded type implements -
+// http.Hijacker for the WebSocket upgrade, http.Flusher for incremental
+// flushing of streamed responses - can see through statusRecorder instead of
+// only seeing the plain http.ResponseWriter methods it declares.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// retryAfterReauthentication re-authenticates the calling tenant's session
+// and replays the given (already upstream-bound) request once, used when a
+// response turns out to be a stale-session login page instead of the page
+// that was requested.
+func (s *server) retryAfterReauthentication(originalReq *http.Request) (*http.Response, error) {
+	t := tenantFromRequest(originalReq)
+	if t == nil {
+		return nil, fmt.Errorf("no tenant resolved for request")
 	}
 
-	// Copy headers from the original request
-	for name, values := range r.Header {
-		for _, value := range values {
-			if strings.ToLower(name) == "cookie" {
-				continue
-			}
-			if strings.ToLower(name) == "referer" {
-				continue
-			}
-			if strings.ToLower(name) == "accept-encoding" {
-				continue
-			}
-			proxyReq.Header.Add(name, value)
+	if err := t.authenticateClient(); err != nil {
+		recordReauthOutcome(originalReq, "failure")
+		return nil, fmt.Errorf("re-authentication failed: %w", err)
+	}
+	recordReauthOutcome(originalReq, "success")
+
+	retryReq := originalReq.Clone(originalReq.Context())
+	if originalReq.GetBody != nil {
+		body, err := originalReq.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("could not replay request body: %w", err)
 		}
+		retryReq.Body = body
+	}
+
+	return t.doRequest(retryReq)
+}
+
+// recordReauthOutcome reports a re-authentication's outcome to Prometheus,
+// and to the requestMetrics carried on r's context, if any, so ServeHTTP's
+// final structured log line reflects it too.
+func recordReauthOutcome(r *http.Request, outcome string) {
+	metrics.ReauthenticationsTotal.WithLabelValues(outcome).Inc()
+	if m := requestMetricsFromRequest(r); m != nil {
+		m.reauthOutcome = outcome
+	}
+}
+
+// modifyResponse rewrites Location headers on every response and, if the
+// response is a redirect back to the login page, transparently re-
+// authenticates and retries - a stale session can surface this way on a
+// response of any content type, not just HTML. It additionally rewrites
+// URLs in HTML/CSS bodies. Any other content type (attachments, images,
+// JSON, ...) is left as resp.Body and streamed straight through by the
+// reverse proxy without ever being buffered in memory.
+func (s *server) modifyResponse(resp *http.Response) error {
+	if location := resp.Header.Get("Location"); location != "" {
+		resp.Header.Set("Location", s.rewriteURL(location))
+	}
+
+	if isRedirectToLogin(resp) {
+		if err := s.reauthenticateAndReplace(resp); err != nil {
+			return err
+		}
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	switch {
+	case strings.Contains(contentType, "text/html"):
+		return s.rewriteResponseHTML(resp)
+	case strings.Contains(contentType, "text/css"):
+		return s.rewriteResponseCSS(resp)
+	default:
+		return nil
 	}
-	proxyReq.Header.Set("User-Agent", userAgent)
-	proxyReq.Header.Set("Origin", s.targetBaseURL)
+}
 
-	// Perform the request
-	resp, err := s.doRequest(proxyReq)
+// reauthenticateAndReplace re-authenticates the tenant behind resp.Request
+// and replaces resp's status, headers and body in place with the retried
+// response's, rewriting its Location header if it redirects.
+func (s *server) reauthenticateAndReplace(resp *http.Response) error {
+	retried, err := s.retryAfterReauthentication(resp.Request)
 	if err != nil {
 		return err
 	}
+	defer retried.Body.Close()
 
-	defer resp.Body.Close()
-
-	responseBodyBytes, err := io.ReadAll(resp.Body)
+	bodyBytes, err := io.ReadAll(retried.Body)
 	if err != nil {
-		return fmt.Errorf("error reading response body: %w", err)
+		return fmt.Errorf("could not read retried response body: %w", err)
 	}
-	responseBody := string(responseBodyBytes)
 
-	contentType := resp.Header.Get("Content-Type")
-	if strings.Contains(contentType, "text/html") {
-		// Quick and dirty way to rewrite URLs in form action attributes and links
-		responseBodyNew := s.replaceHTMLContent(responseBody)
-		responseBodyBytes = []byte(responseBodyNew)
+	resp.Body.Close()
+	resp.StatusCode = retried.StatusCode
+	resp.Status = retried.Status
+	resp.Header = retried.Header
+	setRewrittenBody(resp, bodyBytes)
+	if location := resp.Header.Get("Location"); location != "" {
+		resp.Header.Set("Location", s.rewriteURL(location))
 	}
+	return nil
+}
 
-	if isLoginPage(responseBody) || isRedirectToLogin(resp) {
-		return fmt.Errorf("not logged in anymore")
+func (s *server) rewriteResponseHTML(resp *http.Response) error {
+	bodyBytes, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("could not read response body: %w", err)
 	}
 
-	// Copy response headers
-	for name, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(name, value)
+	if isLoginPage(string(bodyBytes)) {
+		if err := s.reauthenticateAndReplace(resp); err != nil {
+			return err
+		}
+		bodyBytes, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("could not read response body: %w", err)
 		}
 	}
 
-	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
-		location := resp.Header.Get("Location")
-		location = s.getLocation(location)
-		w.Header().Set("Location", location)
+	rewritten, err := rewriteHTMLBytes(bodyBytes, s.rewriteURL)
+	if err != nil {
+		return fmt.Errorf("could not rewrite HTML body: %w", err)
 	}
 
-	w.Header().Set("Content-Length", strconv.Itoa(len(responseBodyBytes)))
-
-	// Write the status code
-	w.WriteHeader(resp.StatusCode)
+	setRewrittenBody(resp, rewritten)
+	return nil
+}
 
-	// Copy the response body
-	_, err = w.Write(responseBodyBytes)
+func (s *server) rewriteResponseCSS(resp *http.Response) error {
+	bodyBytes, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
 	if err != nil {
-		log.Printf("error copying response body: %v", err)
+		return fmt.Errorf("could not read response body: %w", err)
 	}
+
+	rewritten := []byte(rewriteCSSString(string(bodyBytes), s.rewriteURL))
+	setRewrittenBody(resp, rewritten)
 	return nil
 }
 
-func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("proxying request: %s %s", r.Method, r.URL.String())
+// setRewrittenBody replaces resp.Body with in-memory content and fixes up the
+// length headers accordingly, since the rewritten body rarely matches the
+// original Content-Length.
+func setRewrittenBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Transfer-Encoding")
+}
 
-	err := s.proxyRequest(w, r)
-	if err != nil {
-		log.Printf("error proxying request: %v", err)
+func (s *server) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("error proxying request: %v", err)
 
-		if errors.Is(err, errUnauthorized) {
-			// Response already written; no re-authentication needed for wrong auth keys.
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "request timed out: "+err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+
+	http.Error(w, "proxy error: "+err.Error(), http.StatusBadGateway)
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := newRequestID()
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+	ctx, reqMetrics := withRequestMetrics(r.Context())
+	r = r.WithContext(ctx)
+
+	ip := clientIP(r)
+
+	defer func() {
+		slog.Info("proxied request",
+			"request_id", requestID,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"remote_ip", ip,
+			"upstream_duration", reqMetrics.upstreamDuration,
+			"reauth_outcome", reqMetrics.reauthOutcome,
+		)
+		metrics.RequestsTotal.WithLabelValues(strconv.Itoa(rec.status)).Inc()
+	}()
+
+	if s.ipGate != nil {
+		if !s.ipGate.allowedByCIDR(ip) {
+			metrics.GateDecisionsTotal.WithLabelValues("cidr_denied").Inc()
+			http.Error(rec, "forbidden", http.StatusForbidden)
 			return
 		}
-
-		if errors.Is(err, context.DeadlineExceeded) {
-			http.Error(w, "request timed out: "+err.Error(), http.StatusGatewayTimeout)
+		if s.ipGate.isBlocked(ip) {
+			metrics.GateDecisionsTotal.WithLabelValues("blocked").Inc()
+			http.Error(rec, "too many invalid attempts, try again later", http.StatusTooManyRequests)
+			return
+		}
+		if !s.ipGate.allowRate(ip) {
+			metrics.GateDecisionsTotal.WithLabelValues("rate_limited").Inc()
+			http.Error(rec, "rate limit exceeded", http.StatusTooManyRequests)
 			return
 		}
+	}
 
-		err = s.authenticateClient()
-		if err != nil {
-			log.Printf("re-authentication failed: %v", err)
-			http.Error(w, "re-authentication failed: "+err.Error(), http.StatusBadGateway)
+	if !s.isAuthorizedRequest(r) {
+		metrics.UnauthorizedAttemptsTotal.Inc()
+		if s.ipGate != nil {
+			s.ipGate.recordInvalidAttempt(ip)
+		}
+		http.Error(rec, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	t := s.tenant
+	if s.tenants != nil {
+		resolved, ok := s.tenants.resolve(rec, r)
+		if !ok {
+			// The authenticator/tenantManager already wrote a challenge,
+			// redirect, or error response.
 			return
 		}
-		err = s.proxyRequest(w, r)
-		if err != nil {
-			log.Printf("proxy error after re-authentication: %v", err)
-			http.Error(w, "proxy error after re-authentication: "+err.Error(), http.StatusBadGateway)
+		t = resolved
+	}
+	r = r.WithContext(withTenant(r.Context(), t))
+
+	if isWebSocketUpgrade(r) {
+		if err := s.proxyWebSocket(rec, r); err != nil {
+			log.Printf("error proxying websocket: %v", err)
 		}
+		return
 	}
+
+	if _, err := s.resolveTargetRequestURI(r); err != nil {
+		http.Error(rec, "invalid request path", http.StatusBadRequest)
+		return
+	}
+
+	s.reverseProxy.ServeHTTP(rec, r)
 }
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveTargetRequestURI(t *testing.T) {
+	tests := []struct {
+		name    string
+		authKey string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "no auth key passes the path through",
+			path: "/owa/auth/logon.aspx?q=1",
+			want: "/owa/auth/logon.aspx?q=1",
+		},
+		{
+			name:    "auth key prefix is stripped",
+			authKey: "secret123",
+			path:    "/_/secret123/owa/auth/logon.aspx",
+			want:    "/owa/auth/logon.aspx",
+		},
+		{
+			name:    "auth key prefix alone resolves to the root",
+			authKey: "secret123",
+			path:    "/_/secret123",
+			want:    "/",
+		},
+		{
+			name:    "missing auth key prefix is rejected",
+			authKey: "secret123",
+			path:    "/owa/auth/logon.aspx",
+			wantErr: true,
+		},
+		{
+			name:    "path traversal past the auth key prefix is rejected",
+			authKey: "secret123",
+			path:    "/_/secret123/../foo",
+			wantErr: true,
+		},
+		{
+			name:    "path traversal deeper past the auth key prefix is rejected",
+			authKey: "secret123",
+			path:    "/_/secret123/a/../../foo",
+			wantErr: true,
+		},
+		{
+			name:    "path traversal without an auth key is rejected",
+			path:    "/../etc/passwd",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{authKey: tt.authKey, targetBaseURL: "https://owa.h-ka.de"}
+			r := httptest.NewRequest("GET", tt.path, nil)
+
+			got, err := s.resolveTargetRequestURI(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolveTargetRequestURI(%q) = %q, want error", tt.path, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveTargetRequestURI(%q) returned unexpected error: %v", tt.path, err)
+			}
+			if got != tt.want {
+				t.Fatalf("resolveTargetRequestURI(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
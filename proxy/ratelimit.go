@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiterConfig configures the authKey gate's per-IP rate limiting,
+// brute-force block list, and CIDR allowlist. The zero value disables all
+// three.
+type RateLimiterConfig struct {
+	// RatePerSecond and Burst configure a token-bucket limiter per IP.
+	// RatePerSecond <= 0 disables per-IP rate limiting.
+	RatePerSecond float64
+	Burst         int
+
+	// BlockAfter is the number of invalid-authKey attempts from one IP
+	// within BlockWindow after which that IP is blocked for BlockDuration.
+	// BlockAfter <= 0 disables the block list.
+	BlockAfter    int
+	BlockWindow   time.Duration
+	BlockDuration time.Duration
+
+	// AllowedCIDRs, when non-empty, rejects every request whose remote IP
+	// doesn't fall inside one of these networks, before anything else in
+	// the gate runs.
+	AllowedCIDRs []*net.IPNet
+}
+
+// enabled reports whether cfg turns on any protection at all, so server can
+// skip building an ipGate entirely when every field is left at its zero value.
+func (cfg RateLimiterConfig) enabled() bool {
+	return cfg.RatePerSecond > 0 || cfg.BlockAfter > 0 || len(cfg.AllowedCIDRs) > 0
+}
+
+// gateCleanupInterval bounds how often ipGate sweeps its per-IP state for
+// entries that have gone idle, so a long-running proxy hammered from an
+// ever-growing set of source IPs doesn't accumulate one limiter per IP
+// forever.
+const gateCleanupInterval = 10 * time.Minute
+
+// gateLimiterIdleTTL is how long an IP's rate limiter is kept after its last
+// request before the next sweep evicts it.
+const gateLimiterIdleTTL = 30 * time.Minute
+
+// ipGate enforces RateLimiterConfig per remote IP ahead of the authKey
+// check, so a scanner hammering the authKey gate is slowed down and
+// eventually locked out instead of burning CPU and log lines on every
+// attempt.
+type ipGate struct {
+	cfg RateLimiterConfig
+
+	mu          sync.Mutex
+	limiters    map[string]*rate.Limiter
+	lastSeen    map[string]time.Time
+	failures    map[string][]time.Time
+	blocked     map[string]time.Time
+	nextCleanup time.Time
+}
+
+func newIPGate(cfg RateLimiterConfig) *ipGate {
+	return &ipGate{
+		cfg:      cfg,
+		limiters: map[string]*rate.Limiter{},
+		lastSeen: map[string]time.Time{},
+		failures: map[string][]time.Time{},
+		blocked:  map[string]time.Time{},
+	}
+}
+
+// cleanupLocked evicts rate limiters, failure histories, and expired blocks
+// for IPs that have gone idle, no more often than gateCleanupInterval. Must
+// be called with g.mu held.
+func (g *ipGate) cleanupLocked(now time.Time) {
+	if now.Before(g.nextCleanup) {
+		return
+	}
+	g.nextCleanup = now.Add(gateCleanupInterval)
+
+	for ip, seen := range g.lastSeen {
+		if now.Sub(seen) > gateLimiterIdleTTL {
+			delete(g.limiters, ip)
+			delete(g.lastSeen, ip)
+		}
+	}
+
+	cutoff := now.Add(-g.cfg.BlockWindow)
+	for ip, attempts := range g.failures {
+		stillFresh := false
+		for _, attempt := range attempts {
+			if attempt.After(cutoff) {
+				stillFresh = true
+				break
+			}
+		}
+		if !stillFresh {
+			delete(g.failures, ip)
+		}
+	}
+
+	for ip, until := range g.blocked {
+		if now.After(until) {
+			delete(g.blocked, ip)
+		}
+	}
+}
+
+// allowedByCIDR reports whether ip is permitted by the CIDR allowlist; true
+// when no allowlist is configured.
+func (g *ipGate) allowedByCIDR(ip string) bool {
+	if len(g.cfg.AllowedCIDRs) == 0 {
+		return true
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, cidr := range g.cfg.AllowedCIDRs {
+		if cidr.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlocked reports whether ip is currently serving a brute-force block,
+// clearing it once it has expired.
+func (g *ipGate) isBlocked(ip string) bool {
+	if g.cfg.BlockAfter <= 0 {
+		return false
+	}
+
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cleanupLocked(now)
+
+	until, ok := g.blocked[ip]
+	if !ok {
+		return false
+	}
+	if now.After(until) {
+		delete(g.blocked, ip)
+		return false
+	}
+	return true
+}
+
+// allowRate consumes one token from ip's bucket, always allowing when rate
+// limiting is disabled.
+func (g *ipGate) allowRate(ip string) bool {
+	if g.cfg.RatePerSecond <= 0 {
+		return true
+	}
+
+	now := time.Now()
+
+	g.mu.Lock()
+	g.cleanupLocked(now)
+	limiter, ok := g.limiters[ip]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(g.cfg.RatePerSecond), g.cfg.Burst)
+		g.limiters[ip] = limiter
+	}
+	g.lastSeen[ip] = now
+	g.mu.Unlock()
+
+	return limiter.Allow()
+}
+
+// recordInvalidAttempt records a failed authKey check for ip, blocking it
+// for BlockDuration once it accumulates BlockAfter failures within
+// BlockWindow.
+func (g *ipGate) recordInvalidAttempt(ip string) {
+	if g.cfg.BlockAfter <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cleanupLocked(now)
+
+	cutoff := now.Add(-g.cfg.BlockWindow)
+
+	kept := g.failures[ip][:0]
+	for _, attempt := range g.failures[ip] {
+		if attempt.After(cutoff) {
+			kept = append(kept, attempt)
+		}
+	}
+	kept = append(kept, now)
+
+	if len(kept) >= g.cfg.BlockAfter {
+		g.blocked[ip] = now.Add(g.cfg.BlockDuration)
+		delete(g.failures, ip)
+		return
+	}
+	g.failures[ip] = kept
+}
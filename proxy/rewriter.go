@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// urlRewriter rewrites a single URL found in proxied content - an attribute
+// value, a CSS url(...) target, or a JS string literal - so that it keeps
+// routing back through this proxy instead of going straight to the upstream.
+type urlRewriter func(rawURL string) string
+
+var (
+	// cssURLPattern matches CSS url(...) references, optionally quoted. Go's
+	// RE2-based regexp engine has no backreferences, so the closing quote
+	// (if any) is matched independently of the opening one rather than
+	// required to be identical - real-world CSS never mismatches them, and
+	// the replace funcs below always reconstruct with the opening quote.
+	cssURLPattern = regexp.MustCompile(`url\(\s*(['"]?)([^'")]+)['"]?\s*\)`)
+	// cssImportPattern matches @import "..."; / @import '...'; statements.
+	cssImportPattern = regexp.MustCompile(`@import\s+(['"])([^'"]+)['"]`)
+	// metaRefreshURLPattern matches the "url=..." part of a meta refresh content value.
+	metaRefreshURLPattern = regexp.MustCompile(`(?i)(url\s*=\s*)(.+)$`)
+	// jsStringURLPattern matches quoted string literals that look like absolute
+	// paths, the only JS-embedded URL shape we can rewrite without a real parser.
+	jsStringURLPattern = regexp.MustCompile(`(["'])(/[^"'\s]*)["']`)
+)
+
+// rewriteCSSString rewrites every url(...) and @import target in a chunk of CSS.
+func rewriteCSSString(css string, rewrite urlRewriter) string {
+	css = cssURLPattern.ReplaceAllStringFunc(css, func(match string) string {
+		groups := cssURLPattern.FindStringSubmatch(match)
+		quote, target := groups[1], groups[2]
+		return fmt.Sprintf("url(%s%s%s)", quote, rewrite(target), quote)
+	})
+	css = cssImportPattern.ReplaceAllStringFunc(css, func(match string) string {
+		groups := cssImportPattern.FindStringSubmatch(match)
+		quote, target := groups[1], groups[2]
+		return fmt.Sprintf("@import %s%s%s", quote, rewrite(target), quote)
+	})
+	return css
+}
+
+// rewriteJSString rewrites absolute-path string literals embedded in inline
+// script bodies. This is necessarily best-effort - without a JS parser we can
+// only recognize quoted strings that already look like a path.
+func rewriteJSString(js string, rewrite urlRewriter) string {
+	return jsStringURLPattern.ReplaceAllStringFunc(js, func(match string) string {
+		groups := jsStringURLPattern.FindStringSubmatch(match)
+		quote, target := groups[1], groups[2]
+		return quote + rewrite(target) + quote
+	})
+}
+
+// rewriteSrcset rewrites each URL in a srcset attribute, leaving the
+// associated width/density descriptors untouched.
+func rewriteSrcset(value string, rewrite urlRewriter) string {
+	candidates := strings.Split(value, ",")
+	for i, candidate := range candidates {
+		fields := strings.Fields(strings.TrimSpace(candidate))
+		if len(fields) == 0 {
+			continue
+		}
+		fields[0] = rewrite(fields[0])
+		candidates[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// rewriteMetaRefresh rewrites the URL in a "<meta http-equiv=refresh>" content
+// value, which has the unusual "N;url=..." shape instead of a plain URL.
+func rewriteMetaRefresh(content string, rewrite urlRewriter) string {
+	return metaRefreshURLPattern.ReplaceAllStringFunc(content, func(match string) string {
+		groups := metaRefreshURLPattern.FindStringSubmatch(match)
+		return groups[1] + rewrite(strings.TrimSpace(groups[2]))
+	})
+}
+
+// isMetaRefresh reports whether a <meta> tag's attributes mark it as a refresh directive.
+func isMetaRefresh(attrs []html.Attribute) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a.Key, "http-equiv") && strings.EqualFold(a.Val, "refresh") {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteTagAttrs rewrites every attribute on tok that can carry a URL.
+func rewriteTagAttrs(tok *html.Token, rewrite urlRewriter) {
+	metaRefresh := tok.Data == "meta" && isMetaRefresh(tok.Attr)
+
+	for i, a := range tok.Attr {
+		switch strings.ToLower(a.Key) {
+		case "href", "src", "action", "formaction", "poster":
+			tok.Attr[i].Val = rewrite(a.Val)
+		case "srcset":
+			tok.Attr[i].Val = rewriteSrcset(a.Val, rewrite)
+		case "style":
+			tok.Attr[i].Val = rewriteCSSString(a.Val, rewrite)
+		case "content":
+			if metaRefresh {
+				tok.Attr[i].Val = rewriteMetaRefresh(a.Val, rewrite)
+			}
+		}
+	}
+}
+
+// rewriteHTML streams r through the standard tokenizer, rewriting attributes,
+// inline <style> blocks, and inline <script> bodies as it goes, and writes the
+// result to w. Start and end tags are re-serialized from their parsed tokens,
+// so attribute quoting and tag-name case may change; all other text, comments
+// and doctypes are copied through byte-for-byte.
+func rewriteHTML(w io.Writer, r io.Reader, rewrite urlRewriter) error {
+	z := html.NewTokenizer(r)
+	var inStyle, inScript bool
+
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if err := z.Err(); err != nil && err != io.EOF {
+				return fmt.Errorf("could not tokenize HTML: %w", err)
+			}
+			return nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			rewriteTagAttrs(&tok, rewrite)
+			switch tok.Data {
+			case "style":
+				inStyle = tok.Type == html.StartTagToken
+			case "script":
+				inScript = tok.Type == html.StartTagToken
+			}
+			if _, err := io.WriteString(w, tok.String()); err != nil {
+				return err
+			}
+		case html.EndTagToken:
+			tok := z.Token()
+			switch tok.Data {
+			case "style":
+				inStyle = false
+			case "script":
+				inScript = false
+			}
+			if _, err := io.WriteString(w, tok.String()); err != nil {
+				return err
+			}
+		case html.TextToken:
+			// z.Text() unescapes HTML entities; that's only safe to write
+			// back out for <style>/<script> bodies, which the tokenizer
+			// never entity-decodes in the first place. Ordinary text nodes
+			// must go out via z.Raw() so entities like "&lt;" or "&amp;"
+			// survive byte-for-byte instead of being unescaped in place.
+			switch {
+			case inStyle:
+				text := rewriteCSSString(string(z.Text()), rewrite)
+				if _, err := io.WriteString(w, text); err != nil {
+					return err
+				}
+			case inScript:
+				text := rewriteJSString(string(z.Text()), rewrite)
+				if _, err := io.WriteString(w, text); err != nil {
+					return err
+				}
+			default:
+				if _, err := w.Write(z.Raw()); err != nil {
+					return err
+				}
+			}
+		default:
+			if _, err := w.Write(z.Raw()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// rewriteHTMLBytes is a convenience wrapper around rewriteHTML for callers
+// that already hold the whole document in memory.
+func rewriteHTMLBytes(body []byte, rewrite urlRewriter) ([]byte, error) {
+	var out bytes.Buffer
+	if err := rewriteHTML(&out, bytes.NewReader(body), rewrite); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
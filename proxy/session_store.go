@@ -0,0 +1,16 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// SessionStore loads and saves the cookie jar contents that represent an
+// authenticated upstream session, so a restart - or another replica behind
+// the same load balancer - can reuse it instead of burning a fresh TOTP code
+// on every process start. Implementations live in proxy/sessionstore and are
+// wired in through NewServer.
+type SessionStore interface {
+	Load(ctx context.Context) ([]*http.Cookie, error)
+	Save(ctx context.Context, cookies []*http.Cookie) error
+}
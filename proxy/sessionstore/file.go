@@ -0,0 +1,86 @@
+package sessionstore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// File persists the session as a single AES-256-GCM encrypted file, so the
+// upstream session cookie never sits on disk in plaintext.
+type File struct {
+	path string
+	gcm  cipher.AEAD
+}
+
+// NewFile derives an AES-256-GCM key from key via SHA-256 and returns a File
+// backed by path. key is typically sourced from the --session-key flag.
+func NewFile(path, key string) (*File, error) {
+	if key == "" {
+		return nil, fmt.Errorf("session key must not be empty")
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("could not create GCM: %w", err)
+	}
+
+	return &File{path: path, gcm: gcm}, nil
+}
+
+func (f *File) Load(_ context.Context) ([]*http.Cookie, error) {
+	ciphertext, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read session file: %w", err)
+	}
+
+	nonceSize := f.gcm.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, fmt.Errorf("session file is corrupt")
+	}
+	nonce, encrypted := ciphertext[:nonceSize], ciphertext[nonceSize:]
+
+	plaintext, err := f.gcm.Open(nil, nonce, encrypted, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt session file: %w", err)
+	}
+
+	var cookies []*http.Cookie
+	if err := json.Unmarshal(plaintext, &cookies); err != nil {
+		return nil, fmt.Errorf("could not parse session file: %w", err)
+	}
+	return cookies, nil
+}
+
+func (f *File) Save(_ context.Context, cookies []*http.Cookie) error {
+	plaintext, err := json.Marshal(cookies)
+	if err != nil {
+		return fmt.Errorf("could not encode cookies: %w", err)
+	}
+
+	nonce := make([]byte, f.gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("could not generate nonce: %w", err)
+	}
+
+	ciphertext := f.gcm.Seal(nonce, nonce, plaintext, nil)
+	if err := os.WriteFile(f.path, ciphertext, 0o600); err != nil {
+		return fmt.Errorf("could not write session file: %w", err)
+	}
+	return nil
+}
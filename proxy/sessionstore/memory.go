@@ -0,0 +1,35 @@
+// Package sessionstore provides pluggable backends for persisting the
+// proxy's authenticated upstream session, so it can survive restarts and be
+// shared across replicas instead of living only in one process's memory.
+package sessionstore
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// Memory keeps the session only for the lifetime of this process. It is the
+// default store and matches the proxy's original behavior: a restart starts
+// cold and re-authenticates.
+type Memory struct {
+	mu      sync.RWMutex
+	cookies []*http.Cookie
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Load(_ context.Context) ([]*http.Cookie, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cookies, nil
+}
+
+func (m *Memory) Save(_ context.Context, cookies []*http.Cookie) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cookies = cookies
+	return nil
+}
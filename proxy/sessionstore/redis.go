@@ -0,0 +1,51 @@
+package sessionstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis persists the session as a single JSON blob under key, letting
+// multiple proxy replicas share one authenticated upstream session.
+type Redis struct {
+	client *redis.Client
+	key    string
+}
+
+func NewRedis(addr, key string) *Redis {
+	return &Redis{
+		client: redis.NewClient(&redis.Options{Addr: addr}),
+		key:    key,
+	}
+}
+
+func (r *Redis) Load(ctx context.Context) ([]*http.Cookie, error) {
+	data, err := r.client.Get(ctx, r.key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read session from redis: %w", err)
+	}
+
+	var cookies []*http.Cookie
+	if err := json.Unmarshal(data, &cookies); err != nil {
+		return nil, fmt.Errorf("could not parse session from redis: %w", err)
+	}
+	return cookies, nil
+}
+
+func (r *Redis) Save(ctx context.Context, cookies []*http.Cookie) error {
+	data, err := json.Marshal(cookies)
+	if err != nil {
+		return fmt.Errorf("could not encode cookies: %w", err)
+	}
+	if err := r.client.Set(ctx, r.key, data, 0).Err(); err != nil {
+		return fmt.Errorf("could not write session to redis: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MatthiasHarzer/hka-2fa-proxy/otp"
+	"github.com/MatthiasHarzer/hka-2fa-proxy/proxy/metrics"
+)
+
+// tenant holds everything needed to maintain one user's authenticated
+// upstream session: their credentials, OTP generator, and an isolated cookie
+// jar. In single-user mode the server has exactly one; in multi-tenant mode
+// the tenantManager keeps one per signed-in user, so cookies are never
+// shared between tenants.
+type tenant struct {
+	id            string
+	targetBaseURL string
+	username      string
+	otpGenerator  otp.Generator
+	jar           *cookiejar.Jar
+	jarMutex      sync.RWMutex
+	sessionStore  SessionStore
+}
+
+func newTenant(id, targetBaseURL, username string, otpGenerator otp.Generator, sessionStore SessionStore) (*tenant, error) {
+	t := &tenant{
+		id:            id,
+		targetBaseURL: targetBaseURL,
+		username:      username,
+		otpGenerator:  otpGenerator,
+		sessionStore:  sessionStore,
+	}
+	if err := t.clearCookies(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// authenticateOrRestore restores a persisted session if one is available,
+// otherwise performs a fresh login.
+func (t *tenant) authenticateOrRestore() error {
+	if t.sessionStore != nil {
+		restored, err := t.restoreSession()
+		if err != nil {
+			return fmt.Errorf("could not restore session: %w", err)
+		}
+		if restored {
+			log.Printf("restored session for %q from session store", t.id)
+			return nil
+		}
+	}
+
+	return t.authenticateClient()
+}
+
+// restoreSession loads a previously persisted session from t.sessionStore, reporting whether one was found.
+func (t *tenant) restoreSession() (bool, error) {
+	cookies, err := t.sessionStore.Load(context.Background())
+	if err != nil {
+		return false, fmt.Errorf("could not load session: %w", err)
+	}
+	if len(cookies) == 0 {
+		return false, nil
+	}
+
+	target, err := url.Parse(t.targetBaseURL)
+	if err != nil {
+		return false, fmt.Errorf("could not parse target base URL: %w", err)
+	}
+
+	if err := t.clearCookies(); err != nil {
+		return false, fmt.Errorf("could not clear cookies: %w", err)
+	}
+	t.jarMutex.Lock()
+	t.jar.SetCookies(target, cookies)
+	t.jarMutex.Unlock()
+
+	return true, nil
+}
+
+// persistSession writes the current jar contents to t.sessionStore, if one is configured.
+func (t *tenant) persistSession() {
+	if t.sessionStore == nil {
+		return
+	}
+
+	target, err := url.Parse(t.targetBaseURL)
+	if err != nil {
+		log.Printf("could not parse target base URL for session persistence: %v", err)
+		return
+	}
+
+	t.jarMutex.RLock()
+	cookies := t.jar.Cookies(target)
+	t.jarMutex.RUnlock()
+
+	if err := t.sessionStore.Save(context.Background(), cookies); err != nil {
+		log.Printf("could not persist session for %q: %v", t.id, err)
+	}
+}
+
+// getLoginParameters performs the initial request to get session cookies and login form parameters.
+func (t *tenant) getLoginParameters() (url.Values, string, error) {
+	// Create a request so we can set headers
+	initialURL := t.targetBaseURL + "/"
+	req, err := http.NewRequest("GET", initialURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not create initial request: %w", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	// The client's CheckRedirect is configured to stop redirects
+	resp, err := t.doRequest(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("initial GET request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// We expect a 302 Found status code
+	if resp.StatusCode != http.StatusFound {
+		return nil, "", fmt.Errorf("expected a 302 redirect, but got status %s", resp.Status)
+	}
+
+	locationHeader := resp.Header.Get("Location")
+	if locationHeader == "" {
+		return nil, "", fmt.Errorf("'Location' header not found in the response")
+	}
+
+	// Parse parameters from the unusual URL format (split by '?')
+	parts := strings.Split(locationHeader, "?")
+	if len(parts) < 2 {
+		return nil, "", fmt.Errorf("could not parse query string from location: %s", locationHeader)
+	}
+	parsedParams, err := url.ParseQuery(parts[len(parts)-1])
+	if err != nil {
+		return nil, "", fmt.Errorf("could not parse query parameters: %w", err)
+	}
+
+	refererURL := t.targetBaseURL + locationHeader
+	return parsedParams, refererURL, nil
+}
+
+// submitLogin submits the login form with the given username and password.
+func (t *tenant) submitLogin(params url.Values, refererURL, username, password string) (*http.Response, error) {
+	// Prepare form data for the POST request
+	formData := url.Values{}
+	formData.Set("curl", params.Get("curl"))
+	formData.Set("curlid", params.Get("curlid"))
+	formData.Set("curlmode", params.Get("curlmode"))
+	formData.Set("username", strings.TrimSpace(username))
+	formData.Set("password", password)
+
+	postURL := fmt.Sprintf("%s/lm_auth_proxy?LMLogon", t.targetBaseURL)
+
+	req, err := http.NewRequest("POST", postURL, strings.NewReader(formData.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("could not create POST request: %w", err)
+	}
+
+	// Set necessary headers
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Referer", refererURL)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Execute the request
+	resp, err := t.doRequest(req)
+	if err != nil {
+		return nil, fmt.Errorf("login POST request failed: %w", err)
+	}
+
+	return resp, nil
+}
+
+func (t *tenant) clearCookies() error {
+	t.jarMutex.Lock()
+	defer t.jarMutex.Unlock()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return fmt.Errorf("could not create cookie jar: %w", err)
+	}
+	t.jar = jar
+	return nil
+}
+
+func (t *tenant) authenticateClient() error {
+	slog.Info("authenticating tenant", "tenant_id", t.id)
+
+	err := t.clearCookies()
+	if err != nil {
+		return fmt.Errorf("could not clear cookies: %w", err)
+	}
+
+	loginParams, refererURL, err := t.getLoginParameters()
+	if err != nil {
+		return fmt.Errorf("could not get login parameters: %w", err)
+	}
+
+	// This is required, as one OTP can only be used once. To prevent timing issues, we wait for the next interval.
+	waitStart := time.Now()
+	t.otpGenerator.WaitForNextInterval()
+	metrics.OTPWaitSeconds.Observe(time.Since(waitStart).Seconds())
+	password := t.otpGenerator.Generate(time.Now())
+
+	loginResp, err := t.submitLogin(loginParams, refererURL, t.username, password)
+	if err != nil {
+		return fmt.Errorf("could not submit login: %w", err)
+	}
+	defer loginResp.Body.Close()
+
+	if !isLoginSuccessful(loginResp) {
+		slog.Error("authentication failed", "tenant_id", t.id)
+		return fmt.Errorf("login failed")
+	}
+
+	slog.Info("authentication succeeded", "tenant_id", t.id)
+
+	return nil
+}
+
+func (t *tenant) getHttpClient(url *url.URL) (*http.Client, error) {
+	t.jarMutex.RLock()
+	defer t.jarMutex.RUnlock()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cookie jar: %w", err)
+	}
+
+	cookies := t.jar.Cookies(url)
+	jar.SetCookies(url, cookies)
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Jar:     jar,
+	}
+
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		// This stops the client from following any redirects
+		return http.ErrUseLastResponse
+	}
+
+	return client, nil
+}
+
+func (t *tenant) saveCookiesFromResponse(url *url.URL, resp *http.Response) {
+	cookies := resp.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+
+	t.jarMutex.Lock()
+	for _, cookie := range cookies {
+		t.jar.SetCookies(url, []*http.Cookie{cookie})
+	}
+	t.jarMutex.Unlock()
+
+	t.persistSession()
+}
+
+func (t *tenant) doRequest(req *http.Request) (*http.Response, error) {
+	client, err := t.getHttpClient(req.URL)
+	if err != nil {
+		return nil, fmt.Errorf("could not get HTTP client: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	t.saveCookiesFromResponse(req.URL, resp)
+
+	return resp, nil
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// tenantManager resolves the calling tenant for each request and lazily
+// authenticates their upstream session the first time that tenant is seen,
+// keeping every tenant's cookies isolated from every other tenant's.
+type tenantManager struct {
+	targetBaseURL string
+	auth          TenantAuthenticator
+	credentials   CredentialSource
+	sessionStore  func(tenantID string) SessionStore
+
+	mu    sync.Mutex
+	inits map[string]*tenantInit
+}
+
+// tenantInit coalesces concurrent first-requests for the same not-yet-seen
+// tenant onto a single authentication attempt, via once. Holding one of
+// these - rather than m.mu - across authenticateOrRestore keeps the global
+// map lock free for every other tenant's requests in the meantime.
+type tenantInit struct {
+	once sync.Once
+
+	tenant    *tenant
+	errStatus int
+	errMsg    string
+}
+
+func newTenantManager(targetBaseURL string, auth TenantAuthenticator, credentials CredentialSource, sessionStore func(tenantID string) SessionStore) *tenantManager {
+	return &tenantManager{
+		targetBaseURL: targetBaseURL,
+		auth:          auth,
+		credentials:   credentials,
+		sessionStore:  sessionStore,
+		inits:         map[string]*tenantInit{},
+	}
+}
+
+// resolve identifies the caller and returns their tenant, lazily
+// authenticating a fresh upstream session the first time that tenant is
+// seen. ok is false if the caller couldn't be identified or authenticated;
+// a response has already been written in that case.
+func (m *tenantManager) resolve(w http.ResponseWriter, r *http.Request) (*tenant, bool) {
+	tenantID, ok := m.auth.Authenticate(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	m.mu.Lock()
+	init, exists := m.inits[tenantID]
+	if !exists {
+		init = &tenantInit{}
+		m.inits[tenantID] = init
+	}
+	m.mu.Unlock()
+
+	init.once.Do(func() {
+		init.tenant, init.errStatus, init.errMsg = m.initTenant(tenantID)
+	})
+
+	if init.tenant == nil {
+		// Authentication failed: forget this attempt so the next request
+		// for tenantID gets a fresh try instead of replaying the same error
+		// forever.
+		m.mu.Lock()
+		delete(m.inits, tenantID)
+		m.mu.Unlock()
+
+		http.Error(w, init.errMsg, init.errStatus)
+		return nil, false
+	}
+
+	return init.tenant, true
+}
+
+// initTenant looks up credentials and authenticates a fresh upstream session
+// for tenantID. It does its own upstream round-trips and TOTP waits without
+// holding m.mu, so one new tenant's login never blocks requests for every
+// other tenant already resolved.
+func (m *tenantManager) initTenant(tenantID string) (t *tenant, errStatus int, errMsg string) {
+	creds, ok := m.credentials.Lookup(tenantID)
+	if !ok {
+		return nil, http.StatusForbidden, "no TOTP credentials configured for this user"
+	}
+
+	var store SessionStore
+	if m.sessionStore != nil {
+		store = m.sessionStore(tenantID)
+	}
+
+	t, err := newTenant(tenantID, m.targetBaseURL, creds.Username, creds.OTPGenerator, store)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Sprintf("could not initialize session for %q: %v", tenantID, err)
+	}
+
+	if err := t.authenticateOrRestore(); err != nil {
+		return nil, http.StatusBadGateway, fmt.Sprintf("could not authenticate %q: %v", tenantID, err)
+	}
+
+	return t, 0, ""
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// isWebSocketUpgrade reports whether r is a WebSocket upgrade handshake.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// proxyWebSocket hijacks the client connection and shuttles the raw
+// WebSocket handshake and frames between the client and the upstream target.
+// OWA's notification and Teams-style live features rely on this upgrade
+// path, which the ReverseProxy in proxy.go has no way to carry.
+func (s *server) proxyWebSocket(w http.ResponseWriter, r *http.Request) error {
+	t := tenantFromRequest(r)
+	if t == nil {
+		return fmt.Errorf("no tenant resolved for request")
+	}
+
+	requestURI, err := s.resolveTargetRequestURI(r)
+	if err != nil {
+		return fmt.Errorf("could not resolve target request URI: %w", err)
+	}
+
+	targetURL, err := url.Parse(s.targetBaseURL + requestURI)
+	if err != nil {
+		return fmt.Errorf("could not parse target URL: %w", err)
+	}
+
+	upstreamConn, err := dialUpstream(targetURL)
+	if err != nil {
+		return fmt.Errorf("could not dial upstream: %w", err)
+	}
+	defer upstreamConn.Close()
+
+	handshakeReq := r.Clone(r.Context())
+	handshakeReq.URL = targetURL
+	handshakeReq.Host = targetURL.Host
+	handshakeReq.RequestURI = ""
+	handshakeReq.Header.Set("User-Agent", userAgent)
+	handshakeReq.Header.Set("Origin", s.targetBaseURL)
+
+	t.jarMutex.RLock()
+	cookies := t.jar.Cookies(targetURL)
+	t.jarMutex.RUnlock()
+	handshakeReq.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		handshakeReq.AddCookie(cookie)
+	}
+
+	if err := handshakeReq.Write(upstreamConn); err != nil {
+		return fmt.Errorf("could not write upgrade request upstream: %w", err)
+	}
+
+	upstreamReader := bufio.NewReader(upstreamConn)
+	upstreamResp, err := http.ReadResponse(upstreamReader, handshakeReq)
+	if err != nil {
+		return fmt.Errorf("could not read upgrade response: %w", err)
+	}
+	defer upstreamResp.Body.Close()
+
+	if upstreamResp.StatusCode != http.StatusSwitchingProtocols {
+		for name, values := range upstreamResp.Header {
+			for _, value := range values {
+				w.Header().Add(name, value)
+			}
+		}
+		w.WriteHeader(upstreamResp.StatusCode)
+		_, err := io.Copy(w, upstreamResp.Body)
+		return err
+	}
+
+	// http.NewResponseController unwraps w (via its Unwrap method, if any)
+	// to find the underlying Hijacker, so hijacking still works when w is
+	// statusRecorder wrapping the real ResponseWriter - a plain `w.(http.Hijacker)`
+	// assertion would not see through that wrapper.
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return fmt.Errorf("could not hijack client connection: %w", err)
+	}
+	defer clientConn.Close()
+
+	if err := upstreamResp.Write(clientBuf); err != nil {
+		return fmt.Errorf("could not write upgrade response to client: %w", err)
+	}
+	if err := clientBuf.Flush(); err != nil {
+		return fmt.Errorf("could not flush upgrade response to client: %w", err)
+	}
+
+	errCh := make(chan error, 2)
+	go shuttle(upstreamConn, clientConn, errCh)
+	go shuttle(clientConn, upstreamReader, errCh)
+
+	if err := <-errCh; err != nil && !errors.Is(err, io.EOF) {
+		log.Printf("websocket connection closed: %v", err)
+	}
+
+	return nil
+}
+
+// shuttle copies everything read from src to dst, reporting the terminal
+// error on done (nil on a clean close, since io.Copy does not report io.EOF).
+func shuttle(dst io.Writer, src io.Reader, done chan<- error) {
+	_, err := io.Copy(dst, src)
+	done <- err
+}
+
+// dialUpstream opens a plain or TLS connection to the target, matching the scheme in targetURL.
+func dialUpstream(targetURL *url.URL) (net.Conn, error) {
+	switch targetURL.Scheme {
+	case "https", "wss":
+		return tls.Dial("tcp", hostWithPort(targetURL, "443"), nil)
+	default:
+		return net.Dial("tcp", hostWithPort(targetURL, "80"))
+	}
+}
+
+func hostWithPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return u.Host + ":" + defaultPort
+}